@@ -17,13 +17,18 @@ limitations under the License.
 package sshutils
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gravitational/trace"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
 )
 
 // NewChConn returns a new net.Conn implemented over
@@ -38,21 +43,89 @@ func NewExclusiveChConn(conn ssh.Conn, ch ssh.Channel) *ChConn {
 	return newChConn(conn, ch, true)
 }
 
+// NewIdleChConn returns a new net.Conn implemented over SSH channel that
+// closes itself once d elapses without any Read or Write activity in either
+// direction. See SetIdleTimeout for details.
+func NewIdleChConn(conn ssh.Conn, ch ssh.Channel, d time.Duration) *ChConn {
+	c := newChConn(conn, ch, false)
+	c.SetIdleTimeout(d)
+	return c
+}
+
 func newChConn(conn ssh.Conn, ch ssh.Channel, exclusive bool) *ChConn {
 	reader, writer := net.Pipe()
+	writeReader, writeWriter := net.Pipe()
 	c := &ChConn{
-		Channel:   ch,
-		conn:      conn,
-		exclusive: exclusive,
-		reader:    reader,
-		writer:    writer,
+		Channel:     ch,
+		conn:        conn,
+		exclusive:   exclusive,
+		reader:      reader,
+		writer:      writer,
+		writeReader: writeReader,
+		writeWriter: writeWriter,
 	}
+	c.lastActive.Store(time.Now())
+	c.openedAt = time.Now()
+	c.doneCtx, c.doneCancel = context.WithCancel(context.Background())
+	c.copyWG.Add(2)
 	// Start copying from the SSH channel to the writer part of the pipe. The
 	// clients are reading from the reader part of the pipe (see Read below).
+	// Unlike a plain io.Copy, this applies the read rate limit (if any, see
+	// SetReadLimit) and tallies BytesIn for Stats.
 	//
 	// This goroutine stops when either the SSH channel closes or this
 	// connection is closed e.g. by a http.Server (see Close below).
-	go io.Copy(writer, ch)
+	go func() {
+		defer c.copyWG.Done()
+		buf := make([]byte, 32*1024)
+		var err error
+		for {
+			var n int
+			n, err = ch.Read(buf)
+			if n > 0 {
+				if limiter := c.loadLimiter(&c.readLimiter); limiter != nil {
+					// Bound the wait by doneCtx, not Background, so a pending
+					// rate-limit wait is aborted as soon as the connection
+					// starts tearing down instead of stalling Close until the
+					// limiter eventually releases tokens.
+					if lerr := waitRateLimit(c.doneCtx, limiter, n); lerr != nil {
+						err = lerr
+					}
+				}
+				atomic.AddUint64(&c.bytesIn, uint64(n))
+				if _, werr := writer.Write(buf[:n]); werr != nil && err == nil {
+					err = werr
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		reason := "eof"
+		if err != io.EOF {
+			reason = err.Error()
+		}
+		c.signalClosed(reason)
+	}()
+	// Start copying from the writeReader part of the write-side pipe to the
+	// SSH channel. Clients write into writeWriter (see Write below), which
+	// supports a real deadline; this goroutine is what actually turns that
+	// into channel traffic.
+	//
+	// This goroutine stops when the write-side pipe is closed, which happens
+	// in Close below.
+	go func() {
+		defer c.copyWG.Done()
+		_, err := io.Copy(ch, writeReader)
+		// io.ErrClosedPipe here just means Close tore down writeReader out
+		// from under us, not a genuine transport error, so it's ignored the
+		// same as a clean io.EOF.
+		if err != nil && err != io.EOF && !errors.Is(err, io.ErrClosedPipe) {
+			c.mu.Lock()
+			c.writeCopyErr = err
+			c.mu.Unlock()
+		}
+	}()
 	return c
 }
 
@@ -71,12 +144,88 @@ type ChConn struct {
 	reader net.Conn
 	// writer is the part of the pipe that receives data from SSH channel.
 	writer net.Conn
+
+	// writeWriter is the part of the write-side pipe that clients write
+	// into; it's a real net.Conn, so SetWriteDeadline on it actually works.
+	writeWriter net.Conn
+	// writeReader is the part of the write-side pipe copied into the SSH
+	// channel by the goroutine started in newChConn.
+	writeReader net.Conn
+	// copyWG tracks the two copy goroutines (channel->reader, writer->channel)
+	// so Close can wait for both to exit before returning.
+	copyWG sync.WaitGroup
+	// writeCopyErr holds any error (other than io.EOF) returned by the
+	// write-side copy goroutine, surfaced by Close.
+	writeCopyErr error
+
+	// lastActive holds the time.Time of the last successful Read or Write,
+	// consulted by the idle timeout monitor goroutine started by
+	// SetIdleTimeout.
+	lastActive atomic.Value
+	// idleCancel, if non-nil, stops the current idle timeout monitor
+	// goroutine when closed.
+	idleCancel chan struct{}
+
+	// closeOnce ensures the done channel/context are only signaled once,
+	// whichever of Close, a peer close/eow@openssh.com request, or channel
+	// EOF observes the teardown first.
+	closeOnce sync.Once
+	// doneCtx is canceled, and its Done channel closed, when the connection
+	// closes. See CloseNotify and Done.
+	doneCtx    context.Context
+	doneCancel context.CancelFunc
+	// exitReason records why the connection closed: "closed" for a local
+	// Close call, "eof" for a clean peer shutdown, the error text of any
+	// other channel read failure, or the name of the close/eow@openssh.com
+	// request if the peer sent one.
+	exitReason atomic.Value
+
+	// openedAt is when this ChConn was constructed, reported via Stats.
+	openedAt time.Time
+	// bytesIn and bytesOut tally bytes read from and written to the SSH
+	// channel, reported via Stats. Accessed atomically.
+	bytesIn, bytesOut uint64
+	// readLimiter and writeLimiter, if set via SetReadLimit/SetWriteLimit,
+	// throttle the channel<->pipe copy in newChConn and Write respectively.
+	// Holds a *rate.Limiter, or nil if no limit is set.
+	readLimiter, writeLimiter atomic.Value
+	// writeDeadline mirrors the deadline set via SetWriteDeadline, so Write
+	// can bound its writeLimiter wait by the same deadline it honors on the
+	// underlying pipe. Holds a time.Time.
+	writeDeadline atomic.Value
+
+	// connInfo holds the *ConnectionInfo negotiated for this connection via
+	// SendConnectionInfo/RecvConnectionInfo, set with SetInfo and read back
+	// with Info. Nil until negotiation completes.
+	connInfo atomic.Value
 }
 
-// Close closes channel and if the ChConn is exclusive, connection as well
+// Info returns the ConnectionInfo negotiated for this connection, or nil if
+// negotiation hasn't completed — either because the peer predates
+// ConnectionInfoRequest and fell back to the legacy ConnectionTypeRequest,
+// or because SetInfo just hasn't been called yet.
+func (c *ChConn) Info() *ConnectionInfo {
+	info, _ := c.connInfo.Load().(*ConnectionInfo)
+	return info
+}
+
+// SetInfo records info as the ConnectionInfo negotiated for this
+// connection, typically via SendConnectionInfo/RecvConnectionInfo, so later
+// callers can retrieve it with Info.
+func (c *ChConn) SetInfo(info ConnectionInfo) {
+	c.connInfo.Store(&info)
+}
+
+// Close closes channel and if the ChConn is exclusive, connection as well.
+// It blocks until both copy goroutines backing Read and Write have exited.
 func (c *ChConn) Close() error {
+	c.signalClosed("closed")
+
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	if c.idleCancel != nil {
+		close(c.idleCancel)
+		c.idleCancel = nil
+	}
 	var errors []error
 	if err := c.Channel.Close(); err != nil {
 		errors = append(errors, err)
@@ -87,6 +236,21 @@ func (c *ChConn) Close() error {
 	if err := c.writer.Close(); err != nil {
 		errors = append(errors, err)
 	}
+	if err := c.writeReader.Close(); err != nil {
+		errors = append(errors, err)
+	}
+	if err := c.writeWriter.Close(); err != nil {
+		errors = append(errors, err)
+	}
+	c.mu.Unlock()
+
+	// Wait for both copy goroutines to exit before reading writeCopyErr,
+	// which the write-side goroutine only writes before it returns.
+	c.copyWG.Wait()
+	if c.writeCopyErr != nil {
+		errors = append(errors, c.writeCopyErr)
+	}
+
 	// Exclusive means close the underlying SSH connection as well.
 	if !c.exclusive {
 		return trace.NewAggregate(errors...)
@@ -97,6 +261,67 @@ func (c *ChConn) Close() error {
 	return trace.NewAggregate(errors...)
 }
 
+// CloseNotify returns a channel that is closed once the connection tears
+// down: on a local Close call, when the copy goroutine observes EOF or an
+// error on the SSH channel, or — for callers that forward their request stream to
+// MonitorRequests — on a peer-sent close/eow@openssh.com request. Callers
+// that previously had to issue a blocking Read to detect a half-closed peer
+// can select on this instead. Use ExitReason to see why.
+func (c *ChConn) CloseNotify() <-chan struct{} {
+	return c.doneCtx.Done()
+}
+
+// Done returns a context that is canceled under the same conditions as
+// CloseNotify, for callers that prefer the context idiom.
+func (c *ChConn) Done() context.Context {
+	return c.doneCtx
+}
+
+// ExitReason reports why the connection closed: "closed" if Close was
+// called locally, "eof" for a clean peer shutdown observed by the copy
+// goroutine, the error text if reading from the SSH channel failed with
+// any other error, or the type of the close/eow@openssh.com request if the
+// peer sent one and MonitorRequests was watching for it. It returns "" until
+// the connection has closed.
+func (c *ChConn) ExitReason() string {
+	reason, _ := c.exitReason.Load().(string)
+	return reason
+}
+
+// signalClosed records reason as the ExitReason and fires CloseNotify/Done,
+// the first time it's called for this connection; later calls are no-ops.
+func (c *ChConn) signalClosed(reason string) {
+	c.closeOnce.Do(func() {
+		c.exitReason.Store(reason)
+		c.doneCancel()
+	})
+}
+
+// MonitorRequests watches reqs — the out-of-band request channel returned
+// alongside the SSH channel by ssh.NewChannel.Accept — for a close or
+// eow@openssh.com ("end of write") request, either of which indicates the
+// peer is done with the channel, and reports it via CloseNotify/Done and
+// ExitReason. Callers that own the channel's request stream should pass it
+// here instead of handing it to ssh.DiscardRequests; other request types
+// are replied to negatively (if a reply was requested) and otherwise
+// ignored. It returns once reqs is closed, so callers should invoke it in
+// its own goroutine.
+func (c *ChConn) MonitorRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "close", "eow@openssh.com":
+			if req.WantReply {
+				req.Reply(true, nil)
+			}
+			c.signalClosed(req.Type)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
 // LocalAddr returns a local address of a connection
 // Uses underlying net.Conn implementation
 func (c *ChConn) LocalAddr() net.Addr {
@@ -111,12 +336,193 @@ func (c *ChConn) RemoteAddr() net.Addr {
 
 // Read reads from the channel.
 func (c *ChConn) Read(data []byte) (int, error) {
-	return c.reader.Read(data)
+	n, err := c.reader.Read(data)
+	if n > 0 {
+		c.touchActivity()
+	}
+	return n, err
+}
+
+// Write writes to the channel via the write-side pipe, so that
+// SetWriteDeadline is honored. If a write rate limit was set with
+// SetWriteLimit, Write waits for tokens first, bounded by the same
+// deadline set via SetWriteDeadline.
+func (c *ChConn) Write(data []byte) (int, error) {
+	if limiter := c.loadLimiter(&c.writeLimiter); limiter != nil {
+		ctx := context.Background()
+		hasDeadline := false
+		if dl, _ := c.writeDeadline.Load().(time.Time); !dl.IsZero() {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, dl)
+			defer cancel()
+			hasDeadline = true
+		}
+		if err := waitRateLimit(ctx, limiter, len(data)); err != nil {
+			// rate.Limiter.WaitN returns its own error, not
+			// context.DeadlineExceeded, when it can tell upfront that the
+			// wait would outlive ctx's deadline — it doesn't even mark ctx
+			// done in that case — so any wait failure under a
+			// deadline-bound ctx means the deadline, not the error value.
+			if hasDeadline {
+				return 0, os.ErrDeadlineExceeded
+			}
+			return 0, err
+		}
+	}
+	n, err := c.writeWriter.Write(data)
+	if n > 0 {
+		c.touchActivity()
+		atomic.AddUint64(&c.bytesOut, uint64(n))
+	}
+	return n, err
+}
+
+// touchActivity records that a Read or Write just succeeded, resetting the
+// idle timeout clock, if one is running.
+func (c *ChConn) touchActivity() {
+	c.lastActive.Store(time.Now())
+}
+
+// SetIdleTimeout configures the connection to close itself once d elapses
+// without any Read or Write activity in either direction. Unlike
+// SetDeadline, the clock is reset by every successful Read or Write.
+//
+// A zero or negative d disables the idle timeout. SetIdleTimeout is not
+// safe to call concurrently with itself.
+func (c *ChConn) SetIdleTimeout(d time.Duration) {
+	c.mu.Lock()
+	if c.idleCancel != nil {
+		close(c.idleCancel)
+		c.idleCancel = nil
+	}
+	if d <= 0 {
+		c.mu.Unlock()
+		return
+	}
+	cancel := make(chan struct{})
+	c.idleCancel = cancel
+	c.mu.Unlock()
+
+	c.touchActivity()
+	go c.monitorIdleTimeout(d, cancel)
+}
+
+// monitorIdleTimeout periodically checks how long it's been since the last
+// Read or Write and closes the connection once that exceeds d. It exits
+// early if cancel is closed, which happens when SetIdleTimeout is called
+// again or the connection is closed.
+func (c *ChConn) monitorIdleTimeout(d time.Duration, cancel <-chan struct{}) {
+	interval := d / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cancel:
+			return
+		case <-ticker.C:
+			last, _ := c.lastActive.Load().(time.Time)
+			if time.Since(last) >= d {
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+// ChConnStats is a snapshot of a ChConn's byte counters and timing.
+type ChConnStats struct {
+	// BytesIn is the number of bytes read from the SSH channel so far.
+	BytesIn uint64
+	// BytesOut is the number of bytes written to the SSH channel so far.
+	BytesOut uint64
+	// OpenedAt is when the ChConn was constructed.
+	OpenedAt time.Time
+	// LastActivity is when the most recent Read or Write completed.
+	LastActivity time.Time
+}
+
+// Stats returns a snapshot of the connection's byte counters and timing.
+func (c *ChConn) Stats() ChConnStats {
+	last, _ := c.lastActive.Load().(time.Time)
+	return ChConnStats{
+		BytesIn:      atomic.LoadUint64(&c.bytesIn),
+		BytesOut:     atomic.LoadUint64(&c.bytesOut),
+		OpenedAt:     c.openedAt,
+		LastActivity: last,
+	}
+}
+
+// rateLimiterBurst is the token-bucket burst size used for SetReadLimit and
+// SetWriteLimit. It's independent of the configured rate: waitRateLimit
+// chunks any larger read/write into burst-sized pieces, so even a very low
+// rate limit throttles throughput instead of rejecting the first chunk
+// bigger than the burst.
+const rateLimiterBurst = 32 * 1024
+
+// SetReadLimit token-bucket rate-limits data read from the SSH channel
+// (tallied as BytesIn) to bytesPerSecond. A limit <= 0 disables read rate
+// limiting. Safe to call at any time; it takes effect on the next chunk
+// read from the channel.
+func (c *ChConn) SetReadLimit(bytesPerSecond rate.Limit) {
+	c.readLimiter.Store(newByteLimiter(bytesPerSecond))
+}
+
+// SetWriteLimit token-bucket rate-limits data written by Write (tallied as
+// BytesOut) to bytesPerSecond. A limit <= 0 disables write rate limiting.
+// Safe to call at any time; it takes effect on the next Write call.
+func (c *ChConn) SetWriteLimit(bytesPerSecond rate.Limit) {
+	c.writeLimiter.Store(newByteLimiter(bytesPerSecond))
+}
+
+// newByteLimiter builds a *rate.Limiter sized in bytes/sec, or returns nil
+// if bytesPerSecond disables limiting.
+func newByteLimiter(bytesPerSecond rate.Limit) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(bytesPerSecond, rateLimiterBurst)
+}
+
+// loadLimiter reads the *rate.Limiter stored in v, returning nil if none
+// has been set.
+func (c *ChConn) loadLimiter(v *atomic.Value) *rate.Limiter {
+	limiter, _ := v.Load().(*rate.Limiter)
+	return limiter
+}
+
+// waitRateLimit blocks, bounded by ctx, until n bytes' worth of tokens are
+// available from limiter. Unlike a single limiter.WaitN(ctx, n) call, it
+// never fails just because n exceeds the limiter's burst: it waits for
+// burst-sized pieces instead, so a read or write larger than the burst is
+// throttled rather than rejected outright.
+func waitRateLimit(ctx context.Context, limiter *rate.Limiter, n int) error {
+	burst := limiter.Burst()
+	for n > 0 {
+		chunk := n
+		if burst > 0 && chunk > burst {
+			chunk = burst
+		}
+		if err := limiter.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
 }
 
 // SetDeadline sets a connection deadline.
 func (c *ChConn) SetDeadline(t time.Time) error {
-	return c.reader.SetDeadline(t)
+	var errors []error
+	if err := c.reader.SetDeadline(t); err != nil {
+		errors = append(errors, err)
+	}
+	if err := c.writeWriter.SetDeadline(t); err != nil {
+		errors = append(errors, err)
+	}
+	return trace.NewAggregate(errors...)
 }
 
 // SetReadDeadline sets a connection read deadline.
@@ -124,14 +530,18 @@ func (c *ChConn) SetReadDeadline(t time.Time) error {
 	return c.reader.SetReadDeadline(t)
 }
 
-// SetWriteDeadline sets write deadline on a connection
-// ignored for the channel connection
+// SetWriteDeadline sets a connection write deadline. Writes that are still
+// blocked on the underlying SSH channel, or waiting on a write rate limit,
+// when t elapses return os.ErrDeadlineExceeded.
 func (c *ChConn) SetWriteDeadline(t time.Time) error {
-	return nil
+	c.writeDeadline.Store(t)
+	return c.writeWriter.SetWriteDeadline(t)
 }
 
 const (
 	// ConnectionTypeRequest is a request sent over a SSH channel that returns a
-	// boolean which indicates the connection type (direct or tunnel).
+	// boolean which indicates the connection type (direct or tunnel). It's the
+	// legacy fallback for peers that don't support the richer
+	// ConnectionInfoRequest negotiation.
 	ConnectionTypeRequest = "x-teleport-connection-type"
 )
@@ -0,0 +1,350 @@
+/*
+Copyright 2015-2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sshutils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
+)
+
+// pipeChannel is a minimal ssh.Channel backed by an in-memory pipe, used to
+// exercise ChConn's Read/Write paths without a real SSH connection.
+type pipeChannel struct {
+	net.Conn
+}
+
+func (pipeChannel) CloseWrite() error { return nil }
+
+func (pipeChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return false, nil
+}
+
+func (pipeChannel) Stderr() io.ReadWriter { return new(bytes.Buffer) }
+
+// blockingChannel is an ssh.Channel whose Write blocks until the channel is
+// closed, simulating a peer that has stopped reading.
+type blockingChannel struct {
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newBlockingChannel() *blockingChannel {
+	return &blockingChannel{closed: make(chan struct{})}
+}
+
+func (b *blockingChannel) Read(data []byte) (int, error) {
+	<-b.closed
+	return 0, io.EOF
+}
+
+func (b *blockingChannel) Write(data []byte) (int, error) {
+	<-b.closed
+	return 0, io.ErrClosedPipe
+}
+
+func (b *blockingChannel) Close() error {
+	b.closeOnce.Do(func() { close(b.closed) })
+	return nil
+}
+
+func (b *blockingChannel) CloseWrite() error { return nil }
+
+func (b *blockingChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	return false, nil
+}
+
+func (b *blockingChannel) Stderr() io.ReadWriter { return new(bytes.Buffer) }
+
+// fakeConn is a minimal ssh.Conn, sufficient for tests that only need the
+// LocalAddr/RemoteAddr/Close plumbing ChConn delegates to it.
+type fakeConn struct{}
+
+func (fakeConn) User() string         { return "" }
+func (fakeConn) SessionID() []byte    { return nil }
+func (fakeConn) ClientVersion() []byte { return nil }
+func (fakeConn) ServerVersion() []byte { return nil }
+func (fakeConn) RemoteAddr() net.Addr { return &net.TCPAddr{} }
+func (fakeConn) LocalAddr() net.Addr  { return &net.TCPAddr{} }
+
+func (fakeConn) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	return false, nil, nil
+}
+
+func (fakeConn) OpenChannel(name string, data []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	return nil, nil, errors.New("OpenChannel not implemented")
+}
+
+func (fakeConn) Close() error { return nil }
+func (fakeConn) Wait() error  { return nil }
+
+// TestChConnReadWrite checks that data flows in both directions once Write
+// was rerouted through its own pipe.
+func TestChConnReadWrite(t *testing.T) {
+	t.Parallel()
+
+	chSide, testSide := net.Pipe()
+	defer testSide.Close()
+
+	c := NewChConn(fakeConn{}, pipeChannel{chSide})
+	defer c.Close()
+
+	writeErrs := make(chan error, 1)
+	go func() {
+		_, err := c.Write([]byte("ping"))
+		writeErrs <- err
+	}()
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(testSide, buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf))
+	require.NoError(t, <-writeErrs)
+
+	go testSide.Write([]byte("pong"))
+	buf = make([]byte, 4)
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err)
+	require.Equal(t, "pong", string(buf))
+}
+
+// TestChConnWriteDeadline checks that SetWriteDeadline is honored: a Write
+// blocked on a slow/stuck SSH channel returns os.ErrDeadlineExceeded once
+// the deadline elapses, instead of hanging forever.
+func TestChConnWriteDeadline(t *testing.T) {
+	t.Parallel()
+
+	ch := newBlockingChannel()
+	c := NewChConn(fakeConn{}, ch)
+	defer c.Close()
+
+	require.NoError(t, c.SetWriteDeadline(time.Now().Add(-time.Second)))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Write([]byte("hello"))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write did not return promptly after the write deadline elapsed")
+	}
+}
+
+// TestChConnIdleTimeout checks that SetIdleTimeout doesn't close the
+// connection before the idle timeout elapses, but closes it once it has
+// gone quiet.
+func TestChConnIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	chSide, testSide := net.Pipe()
+	defer testSide.Close()
+
+	c := NewIdleChConn(fakeConn{}, pipeChannel{chSide}, 50*time.Millisecond)
+	defer c.Close()
+
+	select {
+	case <-c.CloseNotify():
+		t.Fatal("connection closed before the idle timeout elapsed")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	select {
+	case <-c.CloseNotify():
+	case <-time.After(time.Second):
+		t.Fatal("connection did not close after the idle timeout elapsed")
+	}
+	require.Equal(t, "closed", c.ExitReason())
+}
+
+// TestChConnCloseNotify checks that CloseNotify/Done/ExitReason fire for
+// both a local Close and a peer EOF.
+func TestChConnCloseNotify(t *testing.T) {
+	t.Parallel()
+
+	t.Run("local close", func(t *testing.T) {
+		t.Parallel()
+
+		chSide, testSide := net.Pipe()
+		defer testSide.Close()
+
+		c := NewChConn(fakeConn{}, pipeChannel{chSide})
+		require.NoError(t, c.Close())
+
+		select {
+		case <-c.CloseNotify():
+		case <-time.After(time.Second):
+			t.Fatal("CloseNotify did not fire after Close")
+		}
+		require.Equal(t, "closed", c.ExitReason())
+	})
+
+	t.Run("peer eof", func(t *testing.T) {
+		t.Parallel()
+
+		chSide, testSide := net.Pipe()
+		c := NewChConn(fakeConn{}, pipeChannel{chSide})
+		defer c.Close()
+
+		testSide.Close()
+
+		select {
+		case <-c.Done().Done():
+		case <-time.After(time.Second):
+			t.Fatal("Done did not fire after the peer closed")
+		}
+		require.Equal(t, "eof", c.ExitReason())
+	})
+}
+
+// TestChConnMonitorRequests checks that a close/eow@openssh.com request
+// observed by MonitorRequests fires CloseNotify with that request's type as
+// the ExitReason.
+func TestChConnMonitorRequests(t *testing.T) {
+	t.Parallel()
+
+	chSide, testSide := net.Pipe()
+	defer testSide.Close()
+
+	c := NewChConn(fakeConn{}, pipeChannel{chSide})
+	defer c.Close()
+
+	reqs := make(chan *ssh.Request, 1)
+	reqs <- &ssh.Request{Type: "eow@openssh.com"}
+	close(reqs)
+
+	done := make(chan struct{})
+	go func() {
+		c.MonitorRequests(reqs)
+		close(done)
+	}()
+
+	select {
+	case <-c.CloseNotify():
+	case <-time.After(time.Second):
+		t.Fatal("CloseNotify did not fire after an eow@openssh.com request")
+	}
+	require.Equal(t, "eow@openssh.com", c.ExitReason())
+	<-done
+}
+
+// TestWaitRateLimitExceedsBurst checks that waitRateLimit, unlike a bare
+// limiter.WaitN, succeeds when n exceeds the limiter's burst instead of
+// failing instantly: it should wait out burst-sized pieces instead.
+func TestWaitRateLimitExceedsBurst(t *testing.T) {
+	t.Parallel()
+
+	limiter := rate.NewLimiter(rate.Limit(1_000_000), 16)
+	require.Error(t, limiter.WaitN(context.Background(), 64))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	require.NoError(t, waitRateLimit(ctx, limiter, 64))
+}
+
+// TestChConnReadRateLimit checks that SetReadLimit doesn't break a transfer
+// that's within the limiter's burst, and that the bytes read are reflected
+// in Stats.
+func TestChConnReadRateLimit(t *testing.T) {
+	t.Parallel()
+
+	chSide, testSide := net.Pipe()
+	defer testSide.Close()
+
+	c := NewChConn(fakeConn{}, pipeChannel{chSide})
+	defer c.Close()
+	c.SetReadLimit(rate.Limit(1_000_000))
+
+	payload := bytes.Repeat([]byte{'x'}, 4096)
+	go testSide.Write(payload)
+
+	buf := make([]byte, len(payload))
+	_, err := io.ReadFull(c, buf)
+	require.NoError(t, err)
+	require.Equal(t, payload, buf)
+	require.Equal(t, uint64(len(payload)), c.Stats().BytesIn)
+}
+
+// TestChConnCloseUnblocksReadRateLimit checks that Close returns promptly
+// even while the read-copy goroutine is mid-wait on a low read rate limit,
+// instead of stalling until the limiter eventually releases tokens.
+func TestChConnCloseUnblocksReadRateLimit(t *testing.T) {
+	t.Parallel()
+
+	chSide, testSide := net.Pipe()
+	defer testSide.Close()
+
+	c := NewChConn(fakeConn{}, pipeChannel{chSide})
+	c.SetReadLimit(rate.Limit(1))
+	go testSide.Write(bytes.Repeat([]byte{'x'}, 2*rateLimiterBurst))
+	// Drain the first burst so the copy goroutine moves on to the second
+	// chunk, which has to wait on the limiter.
+	buf := make([]byte, rateLimiterBurst)
+	_, err := io.ReadFull(c, buf)
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() { done <- c.Close() }()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Close did not return promptly while a read rate-limit wait was pending")
+	}
+}
+
+// TestChConnWriteRateLimitRespectsDeadline checks that a write blocked on a
+// write rate limit still returns os.ErrDeadlineExceeded once the write
+// deadline elapses, rather than waiting for tokens indefinitely.
+func TestChConnWriteRateLimitRespectsDeadline(t *testing.T) {
+	t.Parallel()
+
+	ch := newBlockingChannel()
+	c := NewChConn(fakeConn{}, ch)
+	defer c.Close()
+
+	// A single byte/sec limit and a payload bigger than the limiter's burst
+	// guarantees the second chunk has to wait long past the deadline below.
+	c.SetWriteLimit(rate.Limit(1))
+	require.NoError(t, c.SetWriteDeadline(time.Now().Add(50*time.Millisecond)))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Write(bytes.Repeat([]byte{'x'}, 2*rateLimiterBurst))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write did not return promptly once the write deadline elapsed")
+	}
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2015-2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sshutils
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gravitational/trace"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// ConnectionInfoRequest is the channel request used to negotiate
+	// connection capabilities between peers that both understand it. A
+	// peer that doesn't recognize it replies false (or, for very old
+	// peers, not at all); callers should treat that as "fall back to the
+	// legacy ConnectionTypeRequest".
+	ConnectionInfoRequest = "x-teleport-connection-info"
+
+	// ConnectionInfoVersion is the current wire version of ConnectionInfo.
+	ConnectionInfoVersion = 1
+)
+
+// ConnectionInfo describes a negotiated connection's capabilities, carried
+// as the JSON payload of a ConnectionInfoRequest channel request. It
+// supersedes the plain boolean exchanged over ConnectionTypeRequest, which
+// only distinguished direct from tunnel connections.
+type ConnectionInfo struct {
+	// Version is the ConnectionInfo wire version the sender speaks.
+	Version int `json:"version"`
+	// Tunnel is true for a reverse tunnel connection, false for a direct one.
+	Tunnel bool `json:"tunnel"`
+	// MultiplexModes lists the multiplexing modes the sender supports, most
+	// preferred first (e.g. "yamux").
+	MultiplexModes []string `json:"multiplex_modes,omitempty"`
+	// Compression is true if the sender supports compressing channel data.
+	Compression bool `json:"compression,omitempty"`
+	// KeepAliveInterval is how often the sender sends keepalive requests.
+	KeepAliveInterval time.Duration `json:"keep_alive_interval,omitempty"`
+	// IdleTimeout is the idle timeout policy (see ChConn.SetIdleTimeout) the
+	// sender intends to apply, advertised so the peer can align its own.
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty"`
+	// PeerID is the sender's node UUID.
+	PeerID string `json:"peer_id,omitempty"`
+	// ClusterName is the name of the sender's Teleport cluster.
+	ClusterName string `json:"cluster_name,omitempty"`
+}
+
+// SendConnectionInfo sends info as a ConnectionInfoRequest over ch and
+// reports whether the peer acknowledged it. info.Version is overwritten
+// with ConnectionInfoVersion before sending. A false, nil result means the
+// peer replied negatively and doesn't support capability negotiation;
+// callers should fall back to the legacy boolean ConnectionTypeRequest in
+// that case.
+func SendConnectionInfo(ch ssh.Channel, info ConnectionInfo) (bool, error) {
+	info.Version = ConnectionInfoVersion
+	payload, err := json.Marshal(info)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	ok, err := ch.SendRequest(ConnectionInfoRequest, true, payload)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	return ok, nil
+}
+
+// RecvConnectionInfo reads channel requests from reqs — the request channel
+// returned alongside ch by ssh.NewChannel.Accept — until it finds a
+// ConnectionInfoRequest, replies to it, and returns its decoded payload.
+// Any other request type seen along the way is replied to negatively (if a
+// reply was wanted) and otherwise discarded, so callers expecting
+// negotiation to be the first request on a freshly accepted channel should
+// call this before handing reqs off to ChConn.MonitorRequests. If reqs
+// closes before a ConnectionInfoRequest arrives, it returns a non-nil
+// error, which callers should treat as "peer predates capability
+// negotiation, fall back to ConnectionTypeRequest".
+func RecvConnectionInfo(reqs <-chan *ssh.Request) (ConnectionInfo, error) {
+	for req := range reqs {
+		if req.Type != ConnectionInfoRequest {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+		var info ConnectionInfo
+		if err := json.Unmarshal(req.Payload, &info); err != nil {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			return ConnectionInfo{}, trace.Wrap(err)
+		}
+		if req.WantReply {
+			req.Reply(true, nil)
+		}
+		return info, nil
+	}
+	return ConnectionInfo{}, trace.BadParameter("peer closed requests before sending a ConnectionInfoRequest")
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2015-2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sshutils
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// recordingChannel is a minimal ssh.Channel that records its SendRequest
+// call and replies as configured, for testing SendConnectionInfo.
+type recordingChannel struct {
+	ssh.Channel
+	ok      bool
+	sendErr error
+
+	gotName      string
+	gotWantReply bool
+	gotPayload   []byte
+}
+
+func (c *recordingChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	c.gotName = name
+	c.gotWantReply = wantReply
+	c.gotPayload = payload
+	return c.ok, c.sendErr
+}
+
+// TestSendConnectionInfo checks that SendConnectionInfo stamps the current
+// wire version, sends it as a ConnectionInfoRequest wanting a reply, and
+// passes back the peer's ack.
+func TestSendConnectionInfo(t *testing.T) {
+	t.Parallel()
+
+	ch := &recordingChannel{ok: true}
+	info := ConnectionInfo{Tunnel: true, PeerID: "node-1"}
+	ok, err := SendConnectionInfo(ch, info)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, ConnectionInfoRequest, ch.gotName)
+	require.True(t, ch.gotWantReply)
+
+	var sent ConnectionInfo
+	require.NoError(t, json.Unmarshal(ch.gotPayload, &sent))
+	require.Equal(t, ConnectionInfoVersion, sent.Version)
+	require.Equal(t, "node-1", sent.PeerID)
+}
+
+// TestSendConnectionInfoRejected checks that a negative ack (the peer
+// doesn't understand ConnectionInfoRequest) is reported as ok=false, nil
+// error, so callers know to fall back to ConnectionTypeRequest.
+func TestSendConnectionInfoRejected(t *testing.T) {
+	t.Parallel()
+
+	ch := &recordingChannel{ok: false}
+	ok, err := SendConnectionInfo(ch, ConnectionInfo{})
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+// TestRecvConnectionInfo checks that RecvConnectionInfo skips unrelated
+// requests and returns the decoded payload of a ConnectionInfoRequest.
+func TestRecvConnectionInfo(t *testing.T) {
+	t.Parallel()
+
+	payload, err := json.Marshal(ConnectionInfo{Version: ConnectionInfoVersion, Tunnel: true})
+	require.NoError(t, err)
+
+	reqs := make(chan *ssh.Request, 2)
+	reqs <- &ssh.Request{Type: "keepalive@openssh.com"}
+	reqs <- &ssh.Request{Type: ConnectionInfoRequest, Payload: payload}
+	close(reqs)
+
+	info, err := RecvConnectionInfo(reqs)
+	require.NoError(t, err)
+	require.True(t, info.Tunnel)
+}
+
+// TestRecvConnectionInfoClosed checks that a peer that closes its request
+// stream without ever sending a ConnectionInfoRequest (e.g. one that
+// predates it) is reported as an error, not a zero ConnectionInfo.
+func TestRecvConnectionInfoClosed(t *testing.T) {
+	t.Parallel()
+
+	reqs := make(chan *ssh.Request)
+	close(reqs)
+
+	_, err := RecvConnectionInfo(reqs)
+	require.Error(t, err)
+}
+
+// TestChConnInfo checks that Info is nil until SetInfo is called, and
+// returns what was set afterward.
+func TestChConnInfo(t *testing.T) {
+	t.Parallel()
+
+	chSide, testSide := net.Pipe()
+	defer testSide.Close()
+
+	c := NewChConn(fakeConn{}, pipeChannel{chSide})
+	defer c.Close()
+	require.Nil(t, c.Info())
+
+	c.SetInfo(ConnectionInfo{ClusterName: "leaf"})
+	require.Equal(t, "leaf", c.Info().ClusterName)
+}